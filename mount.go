@@ -10,8 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
+	"github.com/kata-containers/agent/pkg/safepath"
 	pb "github.com/kata-containers/agent/protocols/grpc"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -20,7 +22,6 @@ import (
 )
 
 const (
-	type9pFs       = "9p"
 	devPrefix      = "/dev/"
 	timeoutHotplug = 3
 	mountPerm      = os.FileMode(0755)
@@ -56,19 +57,30 @@ var flagList = map[string]int{
 	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
 }
 
-func createDestinationDir(dest string) error {
+// createDestinationDir creates the parent directory of the relative
+// destination dest under base, using an *At helper so that no component of
+// the walk can be redirected by a symlink swapped in after the fact.
+func createDestinationDir(base *safepath.Path, dest string) error {
 	targetPath, _ := filepath.Split(dest)
+	if targetPath == "" {
+		return nil
+	}
 
-	return os.MkdirAll(targetPath, mountPerm)
+	return safepath.MkdirAllAt(base, targetPath, mountPerm)
 }
 
-// mount mounts a source in to a destination. This will do some bookkeeping:
-// * evaluate all symlinks
-// * ensure the source exists
-func mount(source, destination, fsType string, flags int, options string) error {
+// mount mounts a source in to a destination relative to base. This will do
+// some bookkeeping:
+// * evaluate all symlinks in source, if requiresHostSource says source
+//   names a real path on the host rather than an opaque driver tag
+// * ensure the destination exists
+// * resolve destination under base with O_NOFOLLOW at every component and
+//   mount through its /proc/self/fd magic symlink, so a symlink swapped in
+//   between the check and the mount cannot redirect it out of base
+func mount(base *safepath.Path, source, destination, fsType string, flags int, options string, requiresHostSource bool) error {
 	var absSource string
 
-	if fsType != type9pFs {
+	if requiresHostSource {
 		var err error
 
 		absSource, err = filepath.EvalSymlinks(source)
@@ -76,19 +88,25 @@ func mount(source, destination, fsType string, flags int, options string) error
 			return grpcStatus.Errorf(codes.Internal, "Could not resolve symlink for source %v", source)
 		}
 
-		if err := ensureDestinationExists(absSource, destination, fsType); err != nil {
+		if err := ensureDestinationExists(base, absSource, destination, fsType); err != nil {
 			return grpcStatus.Errorf(codes.Internal, "Could not create destination mount point: %v: %v",
 				destination, err)
 		}
 	} else {
-		if err := createDestinationDir(destination); err != nil {
-			return err
+		// No host source to stat, so there's no fileInfo to decide
+		// bind-file vs. directory the way ensureDestinationExists does:
+		// every non-host-source driver (9p, virtio-fs, tmpfs) mounts
+		// onto a directory, and that directory may not exist in the
+		// rootfs yet (e.g. a fresh emptyDir-style tmpfs volume), so the
+		// leaf itself must be created here, not just its parent.
+		if err := safepath.MkdirAllAt(base, destination, mountPerm); err != nil {
+			return grpcStatus.Errorf(codes.Internal, "Could not create destination mount point: %v: %v",
+				destination, err)
 		}
 		absSource = source
 	}
 
-	if err := syscall.Mount(absSource, destination,
-		fsType, uintptr(flags), options); err != nil {
+	if err := safepath.MountAt(base, destination, absSource, fsType, uintptr(flags), options); err != nil {
 		return grpcStatus.Errorf(codes.Internal, "Could not bind mount %v to %v: %v",
 			absSource, destination, err)
 	}
@@ -96,26 +114,27 @@ func mount(source, destination, fsType string, flags int, options string) error
 	return nil
 }
 
-// ensureDestinationExists will recursively create a given mountpoint. If directories
-// are created, their permissions are initialized to mountPerm
-func ensureDestinationExists(source, destination string, fsType string) error {
+// ensureDestinationExists will recursively create a given mountpoint
+// relative to base. If directories are created, their permissions are
+// initialized to mountPerm.
+func ensureDestinationExists(base *safepath.Path, source, destination string, fsType string) error {
 	fileInfo, err := os.Stat(source)
 	if err != nil {
 		return grpcStatus.Errorf(codes.Internal, "could not stat source location: %v",
 			source)
 	}
 
-	if err := createDestinationDir(destination); err != nil {
+	if err := createDestinationDir(base, destination); err != nil {
 		return grpcStatus.Errorf(codes.Internal, "could not create parent directory: %v",
 			destination)
 	}
 
 	if fsType != "bind" || fileInfo.IsDir() {
-		if err := os.Mkdir(destination, mountPerm); !os.IsExist(err) {
+		if err := safepath.MkdirAt(base, destination, mountPerm); err != nil {
 			return err
 		}
 	} else {
-		file, err := os.OpenFile(destination, os.O_CREATE, mountPerm)
+		file, err := safepath.OpenAt(base, destination, os.O_CREATE, mountPerm)
 		if err != nil {
 			return err
 		}
@@ -125,12 +144,80 @@ func ensureDestinationExists(source, destination string, fsType string) error {
 	return nil
 }
 
-func parseMountFlagsAndOptions(optionList []string) (int, string, error) {
+// deviceWatches tracks, for this process, which device sources currently
+// have a hotplug watch claimed by waitForDevice. waitForDevice itself keeps
+// no claim bookkeeping of its own for a watch to be released from, so a
+// caller that waited for a device has no way to un-claim it on rollback;
+// this gives it one.
+var (
+	deviceWatchesMu sync.Mutex
+	deviceWatches   = make(map[string]bool)
+)
+
+// claimDeviceWatch records that source's hotplug watch has been claimed,
+// typically right after waitForDevice returns successfully for it.
+func claimDeviceWatch(source string) {
+	deviceWatchesMu.Lock()
+	defer deviceWatchesMu.Unlock()
+
+	deviceWatches[source] = true
+}
+
+// deviceWatchClaimed reports whether source's hotplug watch is currently
+// claimed, so a handler can skip waiting for a device it (or an earlier,
+// rolled-back attempt) already waited for.
+func deviceWatchClaimed(source string) bool {
+	deviceWatchesMu.Lock()
+	defer deviceWatchesMu.Unlock()
+
+	return deviceWatches[source]
+}
+
+// releaseDeviceWatch releases the hotplug watch claimed for source, so that
+// a rolled-back storage transaction does not leave the device considered
+// claimed and block a retried mount of it.
+func releaseDeviceWatch(source string) {
+	deviceWatchesMu.Lock()
+	defer deviceWatchesMu.Unlock()
+
+	delete(deviceWatches, source)
+}
+
+// waitForSysfsEntry polls probe, which should succeed once the sysfs entry
+// it is looking for has been populated by the kernel, for up to
+// timeoutHotplug seconds, retrying every 100ms. Drivers like SCSI use it to
+// wait on their own sysfs entry. waitForDevice does not go through it: the
+// blk driver still waits on a /dev path with waitForDevice.
+func waitForSysfsEntry(probe func() error) error {
+	timeout := time.Now().Add(timeoutHotplug * time.Second)
+
+	var err error
+	for time.Now().Before(timeout) {
+		if err = probe(); err == nil {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return grpcStatus.Errorf(codes.Internal, "Timed out waiting for sysfs entry: %v", err)
+}
+
+// parseMountFlagsAndOptions splits optionList into the numeric mount flags
+// it recognizes and the remaining fstype-specific options, seeded with
+// driver's registered default flags so that a driver's requirements (e.g.
+// a security-relevant flag it always wants set) don't need to be
+// hard-coded into every handler that uses it.
+func parseMountFlagsAndOptions(driver string, optionList []string) (int, string, error) {
 	var (
 		flags   int
 		options []string
 	)
 
+	if _, capabilities, ok := storageDrivers.Lookup(driver); ok {
+		flags |= capabilities.DefaultFlags
+	}
+
 	for _, opt := range optionList {
 		flag, ok := flagList[opt]
 		if ok {
@@ -144,9 +231,10 @@ func parseMountFlagsAndOptions(optionList []string) (int, string, error) {
 	return flags, strings.Join(options, ","), nil
 }
 
-func removeMounts(mounts []string) error {
+// removeMounts unmounts each of mounts, a list of paths relative to base.
+func removeMounts(base *safepath.Path, mounts []string) error {
 	for _, mount := range mounts {
-		if err := syscall.Unmount(mount, 0); err != nil {
+		if err := safepath.UnmountAt(base, mount, 0); err != nil {
 			return err
 		}
 	}
@@ -154,52 +242,123 @@ func removeMounts(mounts []string) error {
 	return nil
 }
 
-type storageDriversHandler func(storage pb.Storage, spec *pb.Spec) (string, error)
+// storageTransaction accumulates the mount points produced by a single
+// addStorages call together with an undo log of every side effect
+// performed along the way, so that a failure partway through the batch can
+// be unwound in reverse order instead of leaking mounts and devices.
+type storageTransaction struct {
+	base      *safepath.Path
+	mounts    []string
+	undo      []func()
+	committed bool
+}
+
+func newStorageTransaction(base *safepath.Path) *storageTransaction {
+	return &storageTransaction{base: base}
+}
+
+// recordMount notes that destination was successfully mounted, so that it
+// is both returned to the caller on success and unmounted on rollback.
+func (t *storageTransaction) recordMount(destination string) {
+	// Prepend, matching the historical mount list ordering used by
+	// removeMounts on shutdown.
+	t.mounts = append([]string{destination}, t.mounts...)
+
+	t.undo = append(t.undo, func() {
+		if err := safepath.UnmountAt(t.base, destination, unix.MNT_DETACH); err != nil {
+			agentLog.WithError(err).WithField("destination", destination).Warn(
+				"could not undo mount during storage transaction rollback")
+		}
+	})
+}
 
-var storageDriversHandlerList = map[string]storageDriversHandler{
-	driver9pType:  storage9pDriverHandler,
-	driverBlkType: storageBlockDeviceDriverHandler,
+// recordSpecMount captures the Source/Type/Options of spec.Mounts[idx]
+// before the caller overwrites them, so rollback can restore the entry to
+// exactly what it was before this transaction touched it.
+func (t *storageTransaction) recordSpecMount(spec *pb.Spec, idx int) {
+	origSource := spec.Mounts[idx].Source
+	origType := spec.Mounts[idx].Type
+	origOptions := spec.Mounts[idx].Options
+
+	t.undo = append(t.undo, func() {
+		spec.Mounts[idx].Source = origSource
+		spec.Mounts[idx].Type = origType
+		spec.Mounts[idx].Options = origOptions
+	})
 }
 
-func storage9pDriverHandler(storage pb.Storage, spec *pb.Spec) (string, error) {
-	return commonStorageHandler(storage, spec)
+// recordDeviceWatch notes that a hotplugged device at source was claimed
+// by waitForDevice, so that rollback can release it for reuse.
+func (t *storageTransaction) recordDeviceWatch(source string) {
+	t.undo = append(t.undo, func() {
+		releaseDeviceWatch(source)
+	})
 }
 
-func storageBlockDeviceDriverHandler(storage pb.Storage, spec *pb.Spec) (string, error) {
-	// First need to make sure the expected device shows up properly.
-	if err := waitForDevice(storage.Source); err != nil {
-		return "", err
+// rollback unwinds every recorded side effect in reverse order. It is a
+// no-op once commit has been called.
+func (t *storageTransaction) rollback() {
+	if t.committed {
+		return
 	}
 
-	return commonStorageHandler(storage, spec)
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
 }
 
-func commonStorageHandler(storage pb.Storage, spec *pb.Spec) (string, error) {
+// commit finalizes the transaction: rollback becomes a no-op and the
+// recorded mount points are returned for the caller to track.
+func (t *storageTransaction) commit() []string {
+	t.committed = true
+	return t.mounts
+}
+
+// storageDriversHandler is the contract every storage driver registers
+// against storageDrivers. base is the container rootfs or sandbox shared
+// path the driver's destinations are relative to; txn records the side
+// effects the handler performs so a failure elsewhere in the batch can
+// unwind them.
+type storageDriversHandler func(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error)
+
+func commonStorageHandler(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error) {
 	if storage.Rootfs {
 		// Mount the storage device.
-		if err := mountStorage(storage); err != nil {
+		if err := mountStorage(base, storage); err != nil {
 			return "", err
 		}
+		txn.recordMount(storage.MountPoint)
 
 		return storage.MountPoint, nil
 	}
 
 	// Update list of Mounts from OCI specification.
-	updateOCIMounts(storage, spec)
+	updateOCIMounts(txn, storage, spec)
 
 	return "", nil
 }
 
-func mountStorage(storage pb.Storage) error {
-	flags, options, err := parseMountFlagsAndOptions(storage.Options)
+// mountStorage mounts storage at storage.MountPoint, a path relative to
+// base (the container rootfs or sandbox shared path).
+func mountStorage(base *safepath.Path, storage pb.Storage) error {
+	flags, options, err := parseMountFlagsAndOptions(storage.Driver, storage.Options)
 	if err != nil {
 		return err
 	}
 
-	return mount(storage.Source, storage.MountPoint, storage.Fstype, flags, options)
+	var requiresHostSource bool
+	if _, capabilities, ok := storageDrivers.Lookup(storage.Driver); ok {
+		requiresHostSource = capabilities.RequiresHostSource
+	}
+
+	return mount(base, storage.Source, storage.MountPoint, storage.Fstype, flags, options, requiresHostSource)
 }
 
-func updateOCIMounts(storage pb.Storage, spec *pb.Spec) {
+// updateOCIMounts patches the spec.Mounts entry matching storage.MountPoint,
+// if any, with storage's source/fstype/options. The fields it overwrites
+// are captured and recorded against txn beforehand, so that a later
+// rollback can restore them exactly.
+func updateOCIMounts(txn *storageTransaction, storage pb.Storage, spec *pb.Spec) {
 	if spec == nil {
 		return
 	}
@@ -216,6 +375,9 @@ func updateOCIMounts(storage pb.Storage, spec *pb.Spec) {
 				"new-mount-options": storage.Options,
 				"destination":       storage.MountPoint,
 			}).Info("updating OCI mount entry")
+
+			txn.recordSpecMount(spec, idx)
+
 			spec.Mounts[idx].Source = storage.Source
 			spec.Mounts[idx].Type = storage.Fstype
 			spec.Mounts[idx].Options = storage.Options
@@ -224,30 +386,76 @@ func updateOCIMounts(storage pb.Storage, spec *pb.Spec) {
 	}
 }
 
-func addStorages(storages []*pb.Storage, spec *pb.Spec) ([]string, error) {
-	var mountList []string
+// addStorages sets up all of storages relative to base, the container
+// rootfs or sandbox shared path, and returns the list of mount points that
+// were created so the caller can tear them down later with removeMounts.
+//
+// storages, any image/rootfs mounts among them, and spec's own Mounts are
+// first merged into a mountTable so that overlapping destinations - a
+// Kubernetes pod spec, an image volume, and a hotplugged block device all
+// targeting the same path - resolve predictably instead of depending on
+// slice order, before anything is actually mounted.
+//
+// The whole batch is transactional: if any storage fails to set up, every
+// mount, spec mutation and device watch performed by the storages that
+// came before it is unwound before the error is returned, so a partial
+// failure never leaves the sandbox in a half-mounted state.
+func addStorages(base *safepath.Path, storages []*pb.Storage, spec *pb.Spec) ([]string, error) {
+	table := newMountTable()
 
 	for _, storage := range storages {
 		if storage == nil {
 			continue
 		}
 
-		devHandler, ok := storageDriversHandlerList[storage.Driver]
-		if !ok {
-			return nil, grpcStatus.Errorf(codes.InvalidArgument,
-				"Unknown storage driver %q", storage.Driver)
+		priority := mountPriorityStorage
+		if storage.Rootfs {
+			priority = mountPriorityImage
 		}
 
-		mountPoint, err := devHandler(*storage, spec)
-		if err != nil {
+		if err := table.ingest(&mountPlanEntry{
+			destination: storage.MountPoint,
+			fstype:      storage.Fstype,
+			priority:    priority,
+			storage:     storage,
+		}); err != nil {
 			return nil, err
 		}
+	}
+
+	if spec != nil {
+		for _, mnt := range spec.Mounts {
+			if err := table.ingest(&mountPlanEntry{
+				destination: mnt.Destination,
+				fstype:      mnt.Type,
+				priority:    mountPriorityOCISpec,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	txn := newStorageTransaction(base)
+	defer txn.rollback()
+
+	for _, entry := range table.plan() {
+		if entry.storage == nil {
+			// A plain OCI spec mount with no backing storage: the
+			// container runtime applies it itself, nothing for the
+			// agent to do.
+			continue
+		}
 
-		if mountPoint != "" {
-			// Prepend mount point to mount list.
-			mountList = append([]string{mountPoint}, mountList...)
+		devHandler, _, ok := storageDrivers.Lookup(entry.storage.Driver)
+		if !ok {
+			return nil, grpcStatus.Errorf(codes.InvalidArgument,
+				"Unknown storage driver %q", entry.storage.Driver)
+		}
+
+		if _, err := devHandler(base, txn, *entry.storage, spec); err != nil {
+			return nil, err
 		}
 	}
 
-	return mountList, nil
+	return txn.commit(), nil
 }
@@ -0,0 +1,122 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	"google.golang.org/grpc/codes"
+	grpcStatus "google.golang.org/grpc/status"
+)
+
+// Mount priority tiers: a higher tier supersedes a lower one at the same
+// destination, with one exception - mountPriorityImage never supersedes or
+// is superseded, since an image/rootfs mount is a real mount that must
+// always be applied, not a placeholder; ingest rejects any overlap between
+// it and another tier instead.
+//
+//   mountPriorityImage   image/rootfs mounts baked into the container image
+//   mountPriorityOCISpec mounts declared by the OCI spec the runtime sent,
+//                        typically placeholders for a volume whose real
+//                        source is supplied later by a Storage
+//   mountPriorityStorage storages carried by the gRPC request itself, which
+//                        must be able to resolve/override a matching OCI
+//                        spec placeholder the way updateOCIMounts always has
+const (
+	mountPriorityImage = iota
+	mountPriorityOCISpec
+	mountPriorityStorage
+)
+
+// mountPlanEntry is a single mount destination slated for addStorages to
+// set up. storage is nil for an entry that exists only in the OCI spec: the
+// agent takes no action for it since the container runtime applies OCI
+// spec mounts itself.
+type mountPlanEntry struct {
+	destination string
+	fstype      string
+	priority    int
+	storage     *pb.Storage
+}
+
+// mountTable collects mount entries from multiple sources - image/rootfs
+// mounts, storages from the gRPC request, and OCI spec mounts - keyed by
+// their cleaned destination, and resolves overlaps with supersession
+// semantics: an entry from a higher-priority tier replaces one from a
+// lower tier at the same destination; two entries at the same tier and
+// destination with incompatible fstypes are rejected outright since there
+// is no priority to break the tie.
+type mountTable struct {
+	entries map[string]*mountPlanEntry
+	order   []string
+}
+
+func newMountTable() *mountTable {
+	return &mountTable{entries: make(map[string]*mountPlanEntry)}
+}
+
+// ingest adds entry to the table, applying supersession rules against
+// whatever already occupies its destination.
+func (t *mountTable) ingest(entry *mountPlanEntry) error {
+	dest := filepath.Clean(entry.destination)
+	entry.destination = dest
+
+	existing, ok := t.entries[dest]
+	if !ok {
+		t.entries[dest] = entry
+		t.order = append(t.order, dest)
+		return nil
+	}
+
+	// Image/rootfs mounts are not placeholders the way an OCI spec mount
+	// can be: they are real mounts that must always be applied, so an
+	// overlap involving exactly one of them can never be resolved by
+	// ordinary priority supersession. Reject it instead of silently
+	// dropping the rootfs mount (or the other entry).
+	if (existing.priority == mountPriorityImage) != (entry.priority == mountPriorityImage) {
+		return grpcStatus.Errorf(codes.InvalidArgument,
+			"mount destination %v is claimed by both an image/rootfs mount and a %q mount",
+			dest, entry.fstype)
+	}
+
+	if existing.fstype != entry.fstype && existing.priority == entry.priority {
+		return grpcStatus.Errorf(codes.InvalidArgument,
+			"mount destination %v requested with incompatible fstypes %q and %q",
+			dest, existing.fstype, entry.fstype)
+	}
+
+	if entry.priority >= existing.priority {
+		t.entries[dest] = entry
+	}
+
+	return nil
+}
+
+// plan returns the table's surviving entries in a deterministic order where
+// a child mount destination is always ordered after its parent.
+func (t *mountTable) plan() []*mountPlanEntry {
+	dests := make([]string, len(t.order))
+	copy(dests, t.order)
+
+	depth := func(p string) int {
+		return strings.Count(p, string(filepath.Separator))
+	}
+
+	sort.SliceStable(dests, func(i, j int) bool {
+		return depth(dests[i]) < depth(dests[j])
+	})
+
+	plan := make([]*mountPlanEntry, 0, len(dests))
+	for _, d := range dests {
+		plan = append(plan, t.entries[d])
+	}
+
+	return plan
+}
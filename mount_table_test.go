@@ -0,0 +1,59 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountTableHigherPrioritySupersedesLower(t *testing.T) {
+	assert := assert.New(t)
+
+	table := newMountTable()
+
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/data", fstype: "ext4", priority: mountPriorityOCISpec}))
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/data", fstype: "ext4", priority: mountPriorityStorage}))
+
+	plan := table.plan()
+	assert.Len(plan, 1)
+	assert.Equal(mountPriorityStorage, plan[0].priority)
+}
+
+func TestMountTableImageOverlapErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	table := newMountTable()
+
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/data", fstype: "ext4", priority: mountPriorityImage}))
+	err := table.ingest(&mountPlanEntry{destination: "/data", fstype: "ext4", priority: mountPriorityStorage})
+	assert.Error(err, "an image/rootfs mount must never be silently superseded or dropped")
+}
+
+func TestMountTableSameTierIncompatibleFstypeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	table := newMountTable()
+
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/data", fstype: "ext4", priority: mountPriorityStorage}))
+	err := table.ingest(&mountPlanEntry{destination: "/data", fstype: "xfs", priority: mountPriorityStorage})
+	assert.Error(err)
+}
+
+func TestMountTablePlanOrdersParentBeforeChild(t *testing.T) {
+	assert := assert.New(t)
+
+	table := newMountTable()
+
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/a/b/c", fstype: "ext4", priority: mountPriorityStorage}))
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/a", fstype: "ext4", priority: mountPriorityStorage}))
+	assert.NoError(table.ingest(&mountPlanEntry{destination: "/a/b", fstype: "ext4", priority: mountPriorityStorage}))
+
+	plan := table.plan()
+	assert.Equal([]string{"/a", "/a/b", "/a/b/c"}, []string{plan[0].destination, plan[1].destination, plan[2].destination})
+}
@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kata-containers/agent/pkg/safepath"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageTransactionRollbackUndoesInReverseOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "storagetxn")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	base, err := safepath.Open(tmpDir)
+	assert.NoError(err)
+	defer base.Close()
+
+	txn := newStorageTransaction(base)
+
+	var order []int
+	txn.undo = append(txn.undo, func() { order = append(order, 1) })
+	txn.undo = append(txn.undo, func() { order = append(order, 2) })
+	txn.undo = append(txn.undo, func() { order = append(order, 3) })
+
+	txn.rollback()
+
+	assert.Equal([]int{3, 2, 1}, order)
+}
+
+func TestStorageTransactionCommitDisablesRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "storagetxn")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	base, err := safepath.Open(tmpDir)
+	assert.NoError(err)
+	defer base.Close()
+
+	txn := newStorageTransaction(base)
+	txn.recordMount("mnt1")
+
+	ran := false
+	txn.undo = append(txn.undo, func() { ran = true })
+
+	mounts := txn.commit()
+	assert.Equal([]string{"mnt1"}, mounts)
+
+	txn.rollback()
+	assert.False(ran, "rollback must be a no-op after commit")
+}
+
+func TestReleaseDeviceWatchUnclaims(t *testing.T) {
+	assert := assert.New(t)
+
+	const source = "/dev/test-device-watch"
+
+	assert.False(deviceWatchClaimed(source), "must start unclaimed")
+
+	claimDeviceWatch(source)
+	assert.True(deviceWatchClaimed(source))
+
+	releaseDeviceWatch(source)
+	assert.False(deviceWatchClaimed(source), "release must actually unclaim the watch")
+}
+
+// TestAddStoragesRollsBackOnMidBatchFailure drives addStorages end-to-end
+// through a failure on the last storage of a batch, using a fake driver
+// registered through StorageDriverRegistry so it doesn't need root or real
+// mount syscalls, and checks that the spec mutations performed by the
+// storages before it are undone.
+func TestAddStoragesRollsBackOnMidBatchFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "addstorages")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	base, err := safepath.Open(tmpDir)
+	assert.NoError(err)
+	defer base.Close()
+
+	const okDriver = "test-addstorages-ok"
+	assert.NoError(storageDrivers.Register(okDriver, commonStorageHandler, storageDriverCapabilities{}))
+
+	origMounts := []*pb.Mount{
+		{Destination: "/mnt/one", Source: "orig-one", Type: "orig-type"},
+		{Destination: "/mnt/two", Source: "orig-two", Type: "orig-type"},
+	}
+	spec := &pb.Spec{Mounts: []*pb.Mount{
+		{Destination: "/mnt/one", Source: "orig-one", Type: "orig-type"},
+		{Destination: "/mnt/two", Source: "orig-two", Type: "orig-type"},
+	}}
+
+	storages := []*pb.Storage{
+		{MountPoint: "/mnt/one", Driver: okDriver, Fstype: "new-type", Source: "new-one"},
+		{MountPoint: "/mnt/two", Driver: "test-addstorages-missing", Fstype: "new-type", Source: "new-two"},
+	}
+
+	_, err = addStorages(base, storages, spec)
+	assert.Error(err, "addStorages must fail when a storage names an unregistered driver")
+	assert.Equal(origMounts, spec.Mounts, "spec must be restored to its pre-call state after rollback")
+}
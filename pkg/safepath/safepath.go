@@ -0,0 +1,306 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package safepath provides filesystem helpers that are safe to use against
+// a destination tree that may contain attacker-controlled symlinks, such as
+// a guest rootfs populated from an untrusted image or a 9p mount coming from
+// the host.
+//
+// A Path wraps an already-resolved location as an open file descriptor
+// (O_PATH), so that a symlink swapped in after a lookup cannot redirect a
+// later operation: every walk rejects absolute components and ".." that
+// would escape the base, and every leaf operation is performed through
+// /proc/self/fd/N rather than by re-resolving a string path.
+package safepath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Path is a location in the filesystem that has already been resolved and is
+// held open via a file descriptor opened with O_PATH, so that it can be used
+// as the base of further *At operations without being re-resolved from a
+// string.
+type Path struct {
+	fd   int
+	name string
+}
+
+// Open resolves root and returns a Path rooted at it. The caller must call
+// Close when done with it.
+func Open(root string) (*Path, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open base path %v: %v", root, err)
+	}
+
+	return &Path{fd: fd, name: root}, nil
+}
+
+// Close releases the file descriptor held by p.
+func (p *Path) Close() error {
+	return unix.Close(p.fd)
+}
+
+// procPath returns the /proc/self/fd magic symlink for p, through which leaf
+// operations are performed so that they act on the exact inode p refers to.
+func (p *Path) procPath() string {
+	return fmt.Sprintf("/proc/self/fd/%d", p.fd)
+}
+
+// JoinNoFollow walks unsafe component-by-component starting from base,
+// opening each component with O_NOFOLLOW|O_PATH so that no component may be
+// a symlink. Absolute components and ".." segments that would escape base
+// are rejected. The returned Path refers to the fully resolved location and
+// must be closed by the caller.
+func JoinNoFollow(base *Path, unsafe string) (*Path, error) {
+	if filepath.IsAbs(unsafe) {
+		return nil, fmt.Errorf("%v: absolute paths are not allowed", unsafe)
+	}
+
+	curFd := base.fd
+	closeCur := func() {}
+	name := base.name
+
+	for _, comp := range cleanComponents(unsafe) {
+		if comp == ".." {
+			return nil, fmt.Errorf("%v: %q would escape base %v", unsafe, comp, base.name)
+		}
+
+		fd, err := openComponentNoFollow(curFd, comp, name)
+		if err != nil {
+			closeCur()
+			return nil, err
+		}
+
+		closeCur()
+		curFd = fd
+		closeCur = func() { unix.Close(fd) }
+		name = filepath.Join(name, comp)
+	}
+
+	if curFd == base.fd {
+		// Nothing was walked: hand back a duplicate of base's fd so that
+		// closing the result leaves base open.
+		fd, err := unix.Dup(base.fd)
+		if err != nil {
+			return nil, err
+		}
+		curFd = fd
+	}
+
+	return &Path{fd: curFd, name: name}, nil
+}
+
+// cleanComponents splits unsafe into its path components, dropping empty
+// and "." entries but keeping ".." so callers can reject it explicitly.
+func cleanComponents(unsafe string) []string {
+	var comps []string
+
+	for _, comp := range strings.Split(filepath.Clean(unsafe), string(filepath.Separator)) {
+		if comp == "" || comp == "." {
+			continue
+		}
+		comps = append(comps, comp)
+	}
+
+	return comps
+}
+
+// openComponentNoFollow opens comp under the directory referred to by
+// parentFd with O_PATH|O_NOFOLLOW and rejects it if it turns out to be a
+// symlink. O_NOFOLLOW alone does not make open(2) fail in that case: it
+// succeeds and returns an fd referring to the symlink itself, which is
+// exactly the TOCTOU escape this package exists to close, so every walk
+// must check for it explicitly via Fstat.
+func openComponentNoFollow(parentFd int, comp, parentName string) (int, error) {
+	fd, err := unix.Openat(parentFd, comp, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("could not walk to %v under %v: %v", comp, parentName, err)
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("could not stat %v under %v: %v", comp, parentName, err)
+	}
+
+	if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		unix.Close(fd)
+		return -1, fmt.Errorf("could not walk to %v under %v: component is a symlink", comp, parentName)
+	}
+
+	return fd, nil
+}
+
+// resolveParent walks to the parent directory of relPath under base and
+// returns it along with the final path component.
+func resolveParent(base *Path, relPath string) (*Path, string, error) {
+	dir, leaf := filepath.Split(filepath.Clean(relPath))
+	if leaf == "" || leaf == "." || leaf == ".." {
+		return nil, "", fmt.Errorf("%v: invalid leaf component", relPath)
+	}
+
+	if dir == "" {
+		// No parent component: the leaf lives directly under base.
+		fd, err := unix.Dup(base.fd)
+		if err != nil {
+			return nil, "", err
+		}
+		return &Path{fd: fd, name: base.name}, leaf, nil
+	}
+
+	parent, err := JoinNoFollow(base, dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return parent, leaf, nil
+}
+
+// OpenAt opens relPath under base, refusing to follow a symlink for the
+// final component: O_NOFOLLOW is always added to flags.
+func OpenAt(base *Path, relPath string, flags int, mode os.FileMode) (*os.File, error) {
+	parent, leaf, err := resolveParent(base, relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+
+	fd, err := unix.Openat(parent.fd, leaf, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode))
+	if err != nil {
+		return nil, fmt.Errorf("could not open %v under %v: %v", leaf, parent.name, err)
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(parent.name, leaf)), nil
+}
+
+// MkdirAt creates relPath as a directory under base with the given mode. It
+// is not an error if the directory already exists.
+func MkdirAt(base *Path, relPath string, mode os.FileMode) error {
+	parent, leaf, err := resolveParent(base, relPath)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	if err := unix.Mkdirat(parent.fd, leaf, uint32(mode)); err != nil && err != unix.EEXIST {
+		return fmt.Errorf("could not create %v under %v: %v", leaf, parent.name, err)
+	}
+
+	return nil
+}
+
+// MkdirAllAt creates relPath and any missing parent directories under base,
+// with the given mode, mirroring os.MkdirAll. It is not an error if any of
+// the directories already exist. Each component is created and walked one
+// at a time via Mkdirat and O_NOFOLLOW, the same way JoinNoFollow walks an
+// existing path, so a symlink swapped in partway through cannot redirect a
+// later component outside of base.
+func MkdirAllAt(base *Path, relPath string, mode os.FileMode) error {
+	if filepath.IsAbs(relPath) {
+		return fmt.Errorf("%v: absolute paths are not allowed", relPath)
+	}
+
+	curFd := base.fd
+	closeCur := func() {}
+	name := base.name
+
+	for _, comp := range cleanComponents(relPath) {
+		if comp == ".." {
+			return fmt.Errorf("%v: %q would escape base %v", relPath, comp, base.name)
+		}
+
+		if err := unix.Mkdirat(curFd, comp, uint32(mode)); err != nil && err != unix.EEXIST {
+			closeCur()
+			return fmt.Errorf("could not create %v under %v: %v", comp, name, err)
+		}
+
+		fd, err := openComponentNoFollow(curFd, comp, name)
+		if err != nil {
+			closeCur()
+			return err
+		}
+
+		closeCur()
+		curFd = fd
+		closeCur = func() { unix.Close(fd) }
+		name = filepath.Join(name, comp)
+	}
+
+	closeCur()
+	return nil
+}
+
+// StatAt stats relPath under base without following a symlink for the final
+// component.
+func StatAt(base *Path, relPath string) (os.FileInfo, error) {
+	parent, leaf, err := resolveParent(base, relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+
+	var stat unix.Stat_t
+	if err := unix.Fstatat(parent.fd, leaf, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, fmt.Errorf("could not stat %v under %v: %v", leaf, parent.name, err)
+	}
+
+	return os.Lstat(fmt.Sprintf("/proc/self/fd/%d/%s", parent.fd, leaf))
+}
+
+// SymlinkAt creates a symlink at relPath under base pointing at oldname.
+func SymlinkAt(oldname string, base *Path, relPath string) error {
+	parent, leaf, err := resolveParent(base, relPath)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	if err := unix.Symlinkat(oldname, parent.fd, leaf); err != nil {
+		return fmt.Errorf("could not create symlink %v under %v: %v", leaf, parent.name, err)
+	}
+
+	return nil
+}
+
+// MountAt mounts source onto relPath under base. The target is resolved
+// with JoinNoFollow and the mount is performed through its /proc/self/fd
+// magic symlink, so a symlink swapped in after resolution cannot redirect
+// the mount outside of base.
+func MountAt(base *Path, relPath, source, fstype string, flags uintptr, data string) error {
+	target, err := JoinNoFollow(base, relPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if err := unix.Mount(source, target.procPath(), fstype, flags, data); err != nil {
+		return fmt.Errorf("could not mount %v onto %v: %v", source, target.name, err)
+	}
+
+	return nil
+}
+
+// UnmountAt unmounts relPath under base.
+func UnmountAt(base *Path, relPath string, flags int) error {
+	target, err := JoinNoFollow(base, relPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if err := unix.Unmount(target.procPath(), flags); err != nil {
+		return fmt.Errorf("could not unmount %v: %v", target.name, err)
+	}
+
+	return nil
+}
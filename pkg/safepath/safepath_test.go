@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package safepath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinNoFollowRejectsSymlinkEscape(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "safepath")
+	assert.NoError(err)
+	defer os.RemoveAll(root)
+
+	outside, err := ioutil.TempDir("", "safepath-outside")
+	assert.NoError(err)
+	defer os.RemoveAll(outside)
+
+	assert.NoError(os.MkdirAll(filepath.Join(root, "dest"), mountTestPerm))
+
+	// Simulate a symlink swapped in between a check and the mount: "dest"
+	// is replaced with a symlink pointing outside of root.
+	assert.NoError(os.RemoveAll(filepath.Join(root, "dest")))
+	assert.NoError(os.Symlink(outside, filepath.Join(root, "dest")))
+
+	base, err := Open(root)
+	assert.NoError(err)
+	defer base.Close()
+
+	_, err = JoinNoFollow(base, "dest")
+	assert.Error(err, "walking through a symlink component must fail")
+}
+
+func TestJoinNoFollowRejectsParentEscape(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "safepath")
+	assert.NoError(err)
+	defer os.RemoveAll(root)
+
+	base, err := Open(root)
+	assert.NoError(err)
+	defer base.Close()
+
+	_, err = JoinNoFollow(base, "../escape")
+	assert.Error(err, "a \"..\" component that escapes base must be rejected")
+}
+
+func TestMkdirAtAndStatAt(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "safepath")
+	assert.NoError(err)
+	defer os.RemoveAll(root)
+
+	base, err := Open(root)
+	assert.NoError(err)
+	defer base.Close()
+
+	// MkdirAt only creates the leaf: its parent must already exist.
+	assert.NoError(os.MkdirAll(filepath.Join(root, "a"), mountTestPerm))
+	assert.NoError(MkdirAt(base, "a/b", mountTestPerm))
+
+	info, err := StatAt(base, "a/b")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(info.IsDir())
+}
+
+func TestMkdirAllAtCreatesIntermediateDirs(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "safepath")
+	assert.NoError(err)
+	defer os.RemoveAll(root)
+
+	base, err := Open(root)
+	assert.NoError(err)
+	defer base.Close()
+
+	assert.NoError(MkdirAllAt(base, "a/b/c", mountTestPerm))
+
+	info, err := StatAt(base, "a/b/c")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(info.IsDir())
+
+	// Calling it again on an already-existing tree must not error.
+	assert.NoError(MkdirAllAt(base, "a/b/c", mountTestPerm))
+}
+
+const mountTestPerm = os.FileMode(0755)
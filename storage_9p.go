@@ -0,0 +1,29 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// +build !no_9p
+
+package main
+
+import (
+	"github.com/kata-containers/agent/pkg/safepath"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+)
+
+const driver9pType = "9p"
+
+func init() {
+	if err := storageDrivers.Register(driver9pType, storage9pDriverHandler, storageDriverCapabilities{
+		RequiresHostSource: false,
+		SupportsHotplug:    false,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func storage9pDriverHandler(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error) {
+	return commonStorageHandler(base, txn, storage, spec)
+}
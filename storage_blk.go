@@ -0,0 +1,38 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"github.com/kata-containers/agent/pkg/safepath"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+)
+
+const driverBlkType = "blk"
+
+func init() {
+	if err := storageDrivers.Register(driverBlkType, storageBlockDeviceDriverHandler, storageDriverCapabilities{
+		RequiresHostSource: true,
+		SupportsHotplug:    true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func storageBlockDeviceDriverHandler(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error) {
+	// First need to make sure the expected device shows up properly,
+	// unless an earlier attempt already claimed this watch and a
+	// rollback hasn't released it since.
+	if !deviceWatchClaimed(storage.Source) {
+		if err := waitForDevice(storage.Source); err != nil {
+			return "", err
+		}
+		claimDeviceWatch(storage.Source)
+	}
+	txn.recordDeviceWatch(storage.Source)
+
+	return commonStorageHandler(base, txn, storage, spec)
+}
@@ -0,0 +1,107 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// storageDriverCapabilities describes what a storage driver needs and
+// supports, so that callers such as parseMountFlagsAndOptions can layer
+// per-driver defaults instead of hard-coding them into each handler.
+type storageDriverCapabilities struct {
+	// RequiresHostSource is true if storage.Source names a real
+	// filesystem path on the host side that mount() must resolve and
+	// validate (a block device, as blk/scsi use), as opposed to an
+	// opaque tag consumed directly by mount(2) (a 9p/virtio-fs tag) or
+	// no host source at all (a driver like tmpfs that is guest-local).
+	RequiresHostSource bool
+	// SupportsHotplug is true if the driver's device can show up after
+	// the agent starts and must be waited for, rather than being present
+	// up front.
+	SupportsHotplug bool
+	// DefaultFlags are mount flags the driver always wants set, ORed
+	// into the flags parsed from storage.Options.
+	DefaultFlags int
+}
+
+// storageDriverRegistration pairs a registered driver's handler with its
+// capabilities.
+type storageDriverRegistration struct {
+	handler      storageDriversHandler
+	capabilities storageDriverCapabilities
+}
+
+// StorageDriverRegistry holds the storage drivers compiled into the agent.
+// Each driver registers itself from an init() in its own file, so adding or
+// removing a driver is a matter of including or excluding that file (for
+// example behind a build tag, to compile a minimal image without 9p)
+// rather than editing a shared list.
+type StorageDriverRegistry struct {
+	mu      sync.RWMutex
+	drivers map[string]storageDriverRegistration
+}
+
+// storageDrivers is the registry the agent's storage handling dispatches
+// through.
+var storageDrivers = &StorageDriverRegistry{
+	drivers: make(map[string]storageDriverRegistration),
+}
+
+// Register adds handler under name with the given capabilities. It returns
+// an error if name is already registered, since that almost always means
+// two driver files were compiled in for the same storage type.
+func (r *StorageDriverRegistry) Register(name string, handler storageDriversHandler, capabilities storageDriverCapabilities) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.drivers[name]; ok {
+		return fmt.Errorf("storage driver %q already registered", name)
+	}
+
+	r.drivers[name] = storageDriverRegistration{handler: handler, capabilities: capabilities}
+
+	return nil
+}
+
+// Lookup returns the handler and capabilities registered under name, and
+// whether name was found at all.
+func (r *StorageDriverRegistry) Lookup(name string) (storageDriversHandler, storageDriverCapabilities, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reg, ok := r.drivers[name]
+
+	return reg.handler, reg.capabilities, ok
+}
+
+// List returns the names of every registered driver in sorted order, e.g.
+// to surface over the agent's gRPC Check/version RPC so the runtime can
+// negotiate which storage types it may send.
+func (r *StorageDriverRegistry) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.drivers))
+	for name := range r.drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ActiveStorageDrivers returns the storage types this build of the agent
+// can handle, i.e. whichever of the built-in driver files weren't excluded
+// by a build tag. This is the hook the agent's gRPC Check/version RPC
+// handler should call to tell the runtime which storage types it may send;
+// that handler is not part of this tree, so the wiring stops here.
+func ActiveStorageDrivers() []string {
+	return storageDrivers.List()
+}
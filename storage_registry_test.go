@@ -0,0 +1,59 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageDriverRegistryRegisterAndLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := &StorageDriverRegistry{drivers: make(map[string]storageDriverRegistration)}
+
+	caps := storageDriverCapabilities{RequiresHostSource: true, SupportsHotplug: true, DefaultFlags: 42}
+	assert.NoError(registry.Register("test-driver", nil, caps))
+
+	_, gotCaps, ok := registry.Lookup("test-driver")
+	assert.True(ok)
+	assert.Equal(caps, gotCaps)
+
+	_, _, ok = registry.Lookup("missing-driver")
+	assert.False(ok)
+}
+
+func TestStorageDriverRegistryRejectsDuplicateRegistration(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := &StorageDriverRegistry{drivers: make(map[string]storageDriverRegistration)}
+
+	assert.NoError(registry.Register("test-driver", nil, storageDriverCapabilities{}))
+	assert.Error(registry.Register("test-driver", nil, storageDriverCapabilities{}))
+}
+
+func TestStorageDriverRegistryListIsSortedAndIncludesBuiltins(t *testing.T) {
+	assert := assert.New(t)
+
+	names := storageDrivers.List()
+	assert.Contains(names, driver9pType)
+	assert.Contains(names, driverBlkType)
+	assert.Contains(names, driverVirtioFSType)
+	assert.Contains(names, driverEphemeralType)
+	assert.Contains(names, driverSCSIType)
+
+	for i := 1; i < len(names); i++ {
+		assert.True(names[i-1] < names[i], "List() must return sorted names")
+	}
+}
+
+func TestActiveStorageDriversMatchesRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(storageDrivers.List(), ActiveStorageDrivers())
+}
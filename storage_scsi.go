@@ -0,0 +1,84 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// +build !no_scsi
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/kata-containers/agent/pkg/safepath"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	"google.golang.org/grpc/codes"
+	grpcStatus "google.golang.org/grpc/status"
+)
+
+const (
+	driverSCSIType  = "scsi"
+	scsiBlockSuffix = "block"
+)
+
+// scsiDevicesPath is a variable, rather than a constant, so that tests can
+// point it at a scratch directory instead of the real sysfs tree.
+var scsiDevicesPath = "/sys/bus/scsi/devices"
+
+func init() {
+	if err := storageDrivers.Register(driverSCSIType, storageSCSIDriverHandler, storageDriverCapabilities{
+		RequiresHostSource: true,
+		SupportsHotplug:    true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// storageSCSIDriverHandler translates a "<host>:<channel>:<target>:<lun>"
+// SCSI address in storage.Source into the /dev/sd* node that the kernel
+// assigned it, then reuses the block-device path.
+func storageSCSIDriverHandler(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error) {
+	devPath, err := getSCSIDevPath(storage.Source)
+	if err != nil {
+		return "", grpcStatus.Errorf(codes.Internal, "Could not find SCSI device %v: %v", storage.Source, err)
+	}
+
+	storage.Source = devPath
+
+	return storageBlockDeviceDriverHandler(base, txn, storage, spec)
+}
+
+// getSCSIDevPath resolves a "<host>:<channel>:<target>:<lun>" SCSI address
+// to the /dev/sd* node the kernel assigned it, by scanning
+// /sys/bus/scsi/devices for the matching address and following its "block"
+// subdirectory. It polls for up to timeoutHotplug seconds since the address
+// may be announced over the vSCSI bus before the kernel has finished
+// creating the device's sysfs entries, the same race waitForDevice guards
+// against for virtio-blk.
+func getSCSIDevPath(scsiAddr string) (string, error) {
+	scsiPath := filepath.Join(scsiDevicesPath, scsiAddr, scsiBlockSuffix)
+
+	var devName string
+
+	findDevName := func() error {
+		entries, err := ioutil.ReadDir(scsiPath)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) != 1 {
+			return grpcStatus.Errorf(codes.Internal, "Unexpected number of entries for SCSI device %v: %d", scsiAddr, len(entries))
+		}
+
+		devName = entries[0].Name()
+		return nil
+	}
+
+	if err := waitForSysfsEntry(findDevName); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(devPrefix, devName), nil
+}
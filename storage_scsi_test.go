@@ -0,0 +1,51 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSCSIDevPath(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "scsi")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	origScsiDevicesPath := scsiDevicesPath
+	scsiDevicesPath = tmpDir
+	defer func() { scsiDevicesPath = origScsiDevicesPath }()
+
+	scsiAddr := "0:0:0:0"
+	blockDir := filepath.Join(tmpDir, scsiAddr, scsiBlockSuffix)
+	assert.NoError(os.MkdirAll(filepath.Join(blockDir, "sda"), mountPerm))
+
+	devPath, err := getSCSIDevPath(scsiAddr)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(devPrefix, "sda"), devPath)
+}
+
+func TestGetSCSIDevPathMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "scsi")
+	assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	origScsiDevicesPath := scsiDevicesPath
+	scsiDevicesPath = tmpDir
+	defer func() { scsiDevicesPath = origScsiDevicesPath }()
+
+	_, err = getSCSIDevPath("1:0:0:0")
+	assert.Error(err)
+}
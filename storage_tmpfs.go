@@ -0,0 +1,42 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// +build !no_tmpfs
+
+package main
+
+import (
+	"github.com/kata-containers/agent/pkg/safepath"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+)
+
+const (
+	driverEphemeralType = "ephemeral"
+	typeTmpFs           = "tmpfs"
+)
+
+func init() {
+	if err := storageDrivers.Register(driverEphemeralType, storageEphemeralDriverHandler, storageDriverCapabilities{
+		RequiresHostSource: false,
+		SupportsHotplug:    false,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// storageEphemeralDriverHandler mounts a size-bounded tmpfs entirely inside
+// the guest. There is no host source: storage.Source is ignored and the
+// size/mode bound is expected to travel through storage.Options (e.g.
+// "size=64m").
+func storageEphemeralDriverHandler(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error) {
+	storage.Fstype = typeTmpFs
+	storage.Source = typeTmpFs
+
+	// mount() creates the full destination directory itself for a
+	// no-host-source driver like this one; nothing to do here beyond
+	// that.
+	return commonStorageHandler(base, txn, storage, spec)
+}
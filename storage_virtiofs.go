@@ -0,0 +1,39 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// +build !no_virtio_fs
+
+package main
+
+import (
+	"github.com/kata-containers/agent/pkg/safepath"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+)
+
+const (
+	driverVirtioFSType = "virtio-fs"
+	typeVirtioFS       = "virtiofs"
+)
+
+func init() {
+	if err := storageDrivers.Register(driverVirtioFSType, storageVirtioFSDriverHandler, storageDriverCapabilities{
+		RequiresHostSource: false,
+		SupportsHotplug:    false,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// storageVirtioFSDriverHandler mounts a virtio-fs shared directory exposed
+// by the host. As with 9p, there is no device to wait for: the virtiofsd
+// daemon is already serving the tag named by storage.Source, and any
+// DAX/cache tuning travels through storage.Options like any other mount
+// option.
+func storageVirtioFSDriverHandler(base *safepath.Path, txn *storageTransaction, storage pb.Storage, spec *pb.Spec) (string, error) {
+	storage.Fstype = typeVirtioFS
+
+	return commonStorageHandler(base, txn, storage, spec)
+}